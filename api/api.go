@@ -3,7 +3,15 @@ package api
 import (
 	"context"
 	"errors"
+	"fmt"
+	"math/rand"
 	"net"
+	"os"
+	"os/signal"
+	"regexp"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"../action"
@@ -52,7 +60,221 @@ var (
 	TopContext context.Context
 )
 
-func runChaosCommand(cmd interface{}, interval time.Duration, names []string, pattern string, chaosFn func(context.Context, container.Client, []string, string, interface{}) error) {
+// ErrExperimentDeadline is the cancellation cause used when an experiment's
+// overall Duration budget (ExperimentOptions.Duration) elapses.
+var ErrExperimentDeadline = errors.New("experiment duration elapsed")
+
+// ErrInterrupted is the cancellation cause used when Run stops TopContext
+// because of an incoming SIGINT, SIGTERM or SIGHUP.
+var ErrInterrupted = errors.New("interrupted by signal")
+
+// undoTasks holds teardown callbacks pushed by chaos commands that leave
+// something behind (e.g. a tc netem qdisc) while they are active, keyed by a
+// token handed back from pushUndo, so Run can reverse all of them on a
+// graceful shutdown even if it is triggered mid-experiment. A map keyed by
+// token - rather than a plain stack - is required because multiple
+// experiments can be active concurrently (e.g. one per target container
+// set), and their teardowns do not necessarily complete in LIFO order.
+var (
+	undoMu    sync.Mutex
+	undoNext  int
+	undoTasks = map[int]func(){}
+)
+
+// pushUndo registers a teardown callback and returns a token that uniquely
+// identifies it for a later popUndo, regardless of what else is pushed or
+// popped in between.
+func pushUndo(undo func()) int {
+	undoMu.Lock()
+	defer undoMu.Unlock()
+	undoNext++
+	token := undoNext
+	undoTasks[token] = undo
+	return token
+}
+
+// popUndo removes and returns the teardown callback registered under token,
+// if it is still pending, without running it.
+func popUndo(token int) (func(), bool) {
+	undoMu.Lock()
+	defer undoMu.Unlock()
+	undo, ok := undoTasks[token]
+	if ok {
+		delete(undoTasks, token)
+	}
+	return undo, ok
+}
+
+// runUndoStack runs and discards every remaining teardown callback.
+func runUndoStack() {
+	undoMu.Lock()
+	pending := undoTasks
+	undoTasks = map[int]func(){}
+	undoMu.Unlock()
+	for _, undo := range pending {
+		undo()
+	}
+}
+
+// Run installs handlers for SIGINT, SIGTERM and SIGHUP that cancel
+// TopContext with ErrInterrupted, and for SIGTSTP that suspends the process
+// so an operator can pause an experiment with Ctrl-Z and resume it with
+// SIGCONT without losing the teardown stack. It blocks until ctx is done or
+// a terminating signal arrives, then runs every registered undo callback -
+// reversing any netem rule still in place - before returning.
+func Run(ctx context.Context) error {
+	cctx, cancel := context.WithCancelCause(ctx)
+	TopContext = cctx
+	defer cancel(nil)
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGTSTP)
+	defer signal.Stop(sigCh)
+
+	for {
+		select {
+		case <-cctx.Done():
+			runUndoStack()
+			return context.Cause(cctx)
+		case sig := <-sigCh:
+			if sig == syscall.SIGTSTP {
+				log.Info("Pausing pumba (SIGTSTP); send SIGCONT to resume")
+				_ = syscall.Kill(syscall.Getpid(), syscall.SIGSTOP)
+				log.Info("Resuming pumba")
+				continue
+			}
+			log.Info("Caught signal, stopping experiments: ", sig)
+			cancel(ErrInterrupted)
+			runUndoStack()
+			return context.Cause(cctx)
+		}
+	}
+}
+
+// ErrChaosFnFailed wraps an error returned by a chaos function so the
+// cancellation cause it produces carries the underlying cause along with it.
+func ErrChaosFnFailed(err error) error {
+	return fmt.Errorf("chaos function failed: %w", err)
+}
+
+// ExperimentOptions bounds how long a chaos experiment is allowed to run and
+// how it reacts to chaosFn errors, so a caller can say e.g. "run netem delay
+// for 10 minutes and give up after 3 failures" instead of looping forever.
+type ExperimentOptions struct {
+	// Duration is the total lifetime of the experiment; zero means run until
+	// TopContext is cancelled.
+	Duration time.Duration
+	// MaxErrors is the number of consecutive chaosFn failures tolerated
+	// before the experiment cancels itself; zero means unlimited.
+	MaxErrors int
+	// StopOnError, when true, cancels the experiment on the very first
+	// chaosFn failure regardless of MaxErrors.
+	StopOnError bool
+	// RetryAttempts is the total number of chaosFn calls made within a
+	// single tick while the error stays retryable, before it counts against
+	// MaxErrors/StopOnError; zero or one means no retry.
+	RetryAttempts int
+	// RetryBaseDelay is the initial backoff delay between retries; it
+	// defaults to one second when unset.
+	RetryBaseDelay time.Duration
+	// RetryMaxDelay caps the exponential backoff delay; it defaults to
+	// 30 seconds when unset.
+	RetryMaxDelay time.Duration
+}
+
+// retryableSubstrings lists lowercase fragments of transient Docker-daemon
+// or network errors that are worth retrying. isRetryable is an allowlist,
+// not a denylist: anything that doesn't match one of these, or net.Error,
+// is treated as permanent (a validation failure like "no such container"
+// will never succeed on retry, and an unrecognised error is safer to fail
+// fast on than to retry blindly).
+var retryableSubstrings = []string{
+	"connection refused",
+	"connection reset",
+	"broken pipe",
+	"i/o timeout",
+	"timed out",
+	"eof",
+	"cannot connect to the docker daemon",
+	"daemon is not running",
+	"service unavailable",
+	"temporarily unavailable",
+	"too many requests",
+}
+
+// isRetryable reports whether err looks like a transient Docker daemon or
+// network error worth retrying, as opposed to a validation failure (e.g. an
+// unknown container) that will never succeed on retry.
+func isRetryable(err error) bool {
+	if err == nil {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	msg := strings.ToLower(err.Error())
+	for _, substr := range retryableSubstrings {
+		if strings.Contains(msg, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+// callWithRetry runs chaosFn, retrying retryable errors with exponential
+// backoff and jitter for at most opts.RetryAttempts calls in all, aborting
+// the backoff wait immediately if ctx is done.
+func callWithRetry(ctx context.Context, chaosFn func(context.Context, container.Client, []string, string, interface{}) error,
+	client container.Client, names []string, pattern string, cmd interface{}, opts ExperimentOptions) error {
+	attempts := opts.RetryAttempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for attempt := 0; attempt < attempts; attempt++ {
+		err = chaosFn(ctx, client, names, pattern, cmd)
+		if err == nil || !isRetryable(err) || attempt == attempts-1 {
+			return err
+		}
+		log.Debug("Retryable chaos error, backing off: ", err)
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoffDelay(opts, attempt)):
+		}
+	}
+	return err
+}
+
+// backoffDelay returns base * 2^attempt, capped at max, plus up to base of
+// random jitter.
+func backoffDelay(opts ExperimentOptions, attempt int) time.Duration {
+	base := opts.RetryBaseDelay
+	if base <= 0 {
+		base = time.Second
+	}
+	max := opts.RetryMaxDelay
+	if max <= 0 {
+		max = 30 * time.Second
+	}
+	delay := base * time.Duration(int64(1)<<uint(attempt))
+	if delay > max || delay <= 0 {
+		delay = max
+	}
+	return delay + time.Duration(rand.Int63n(int64(base)+1))
+}
+
+// runChaosCommand drives chaosFn on the given interval until the experiment
+// is cancelled. If teardown is non-nil, it is registered with the undo
+// registry before the loop starts and is deregistered once the loop exits
+// for any reason except ErrInterrupted. It is also run when the exit has a
+// non-nil cause, so a deadline or StopOnError/MaxErrors exit still reverses
+// whatever chaosFn applied; a one-shot run (interval 0) that completes with
+// a nil cause deregisters it without running it; an
+// ErrInterrupted exit instead leaves the teardown registered for Run's own
+// undo sweep, which may be reversing several concurrent experiments at once.
+func runChaosCommand(cmd interface{}, interval time.Duration, names []string, pattern string, chaosFn func(context.Context, container.Client, []string, string, interface{}) error, opts ExperimentOptions, teardown func()) error {
 	// create Time channel for specified interval
 	var tick <-chan time.Time
 	if interval == 0 {
@@ -62,23 +284,96 @@ func runChaosCommand(cmd interface{}, interval time.Duration, names []string, pa
 	}
 
 	// handle the 'chaos' command
-	ctx, cancel := context.WithCancel(TopContext)
-	for {
-		// cancel current context on exit
-		defer cancel()
-		// run chaos function
-		if err := chaosFn(ctx, Client, names, pattern, cmd); err != nil {
+	var ctx context.Context
+	var cancel context.CancelCauseFunc
+	if opts.Duration > 0 {
+		ctx, cancel = context.WithTimeoutCause(TopContext, opts.Duration, ErrExperimentDeadline)
+	} else {
+		ctx, cancel = context.WithCancelCause(TopContext)
+	}
+	defer cancel(nil)
+
+	var undoToken int
+	if teardown != nil {
+		undoToken = pushUndo(teardown)
+	}
+
+	var cause error
+	var consecutiveErrors int
+	for done := false; !done; {
+		// run chaos function, retrying transient errors with backoff
+		if err := callWithRetry(ctx, chaosFn, Client, names, pattern, cmd, opts); err != nil {
 			log.Error(err)
+			consecutiveErrors++
+			if opts.StopOnError || (opts.MaxErrors > 0 && consecutiveErrors >= opts.MaxErrors) {
+				cancel(ErrChaosFnFailed(err))
+			}
+		} else {
+			consecutiveErrors = 0
 		}
 		// wait for next timer tick or cancel
 		select {
-		case <-TopContext.Done():
-			return // not to leak the goroutine
+		case <-ctx.Done():
+			cause = context.Cause(ctx) // not to leak the goroutine
+			done = true
 		case <-tick:
 			if interval == 0 {
-				return // not to leak the goroutine
+				cause = context.Cause(ctx) // nil unless ctx was also cancelled; not to leak the goroutine
+				done = true
+			} else {
+				log.Debug("Next chaos execution (tick) ...")
 			}
-			log.Debug("Next chaos execution (tick) ...")
+		}
+	}
+
+	if teardown != nil && !errors.Is(cause, ErrInterrupted) {
+		if undo, ok := popUndo(undoToken); ok && cause != nil {
+			undo()
+		}
+	}
+	return cause
+}
+
+// ErrInvalidPercent is returned when a netem percent argument falls outside
+// the valid 0..100 range.
+var ErrInvalidPercent = errors.New("percent must be between 0 and 100")
+
+// validatePercent checks a netem percent argument (e.g. loss/corrupt/
+// duplicate/reorder probability) falls within the 0..100 range tc accepts.
+func validatePercent(percent float64) error {
+	if percent < 0 || percent > 100 {
+		return ErrInvalidPercent
+	}
+	return nil
+}
+
+// rateRegexp matches the tc bitrate syntax accepted by `tc qdisc ... rate`,
+// e.g. "1mbit", "500kbit", "2.5gbit".
+var rateRegexp = regexp.MustCompile(`(?i)^[0-9]+(\.[0-9]+)?(bit|kbit|mbit|gbit|kbps|mbps|gbps)$`)
+
+// validateRate checks rate is a tc-parseable bitrate string.
+func validateRate(rate string) error {
+	if !rateRegexp.MatchString(rate) {
+		return fmt.Errorf("invalid rate %q: expected a tc bitrate like \"1mbit\"", rate)
+	}
+	return nil
+}
+
+// netemTeardown builds the undo callback pushed by the netem commands before
+// they start: it reverses the qdisc (e.g. `tc qdisc del dev eth0 root`) they
+// just applied, via Chaos.StopNetemContainers.
+func netemTeardown(netInterface string, ips []net.IP, image string, names []string, pattern string) func() {
+	return func() {
+		stopCmd := action.CommandNetemStop{
+			NetInterface: netInterface,
+			IPs:          ips,
+			Image:        image,
+		}
+		// TopContext may already be cancelled by the time this callback
+		// runs, so use a fresh context to give the teardown a chance to
+		// reach the Docker daemon.
+		if err := Chaos.StopNetemContainers(context.Background(), Client, names, pattern, stopCmd); err != nil {
+			log.Error(err)
 		}
 	}
 }
@@ -86,21 +381,22 @@ func runChaosCommand(cmd interface{}, interval time.Duration, names []string, pa
 /**
 * Kill a set of containers identified by names []string or pattern string
  */
-func Kill(signal string, interval time.Duration, names []string, pattern string) error {
+func Kill(signal string, interval time.Duration, names []string, pattern string, opts ExperimentOptions) error {
 	if _, ok := LinuxSignals[signal]; !ok {
 		err := errors.New("Unexpected signal: " + signal)
 		log.Error(err)
 		return err
 	}
-	runChaosCommand(action.CommandKill{Signal: signal}, interval, names, pattern, Chaos.KillContainers)
-	return nil
+	cause := runChaosCommand(action.CommandKill{Signal: signal}, interval, names, pattern, Chaos.KillContainers, opts, nil)
+	log.Info("Kill experiment stopped: ", cause)
+	return cause
 }
 
 /**
 * Add delay to incoming network packet for a set of containers identified by names []string or pattern string
  */
 func NetemDelay(interval time.Duration, duration time.Duration, names []string, pattern string,
-	netInterface string, ips []net.IP, image string, time int, jitter int, correlation float64, distribution string) error {
+	netInterface string, ips []net.IP, image string, time int, jitter int, correlation float64, distribution string, opts ExperimentOptions) error {
 	// pepare netem delay command
 	delayCmd := action.CommandNetemDelay{
 		NetInterface: netInterface,
@@ -112,12 +408,14 @@ func NetemDelay(interval time.Duration, duration time.Duration, names []string,
 		Distribution: distribution,
 		Image:        image,
 	}
-	runChaosCommand(delayCmd, interval, names, pattern, Chaos.NetemDelayContainers)
-	return nil
+	cause := runChaosCommand(delayCmd, interval, names, pattern, Chaos.NetemDelayContainers, opts,
+		netemTeardown(netInterface, ips, image, names, pattern))
+	log.Info("NetemDelay experiment stopped: ", cause)
+	return cause
 }
 
 func NetemLossRandom(interval time.Duration, duration time.Duration, names []string, pattern string,
-	netInterface string, ips []net.IP, image string, correlation float64, percent float64) error {
+	netInterface string, ips []net.IP, image string, correlation float64, percent float64, opts ExperimentOptions) error {
 	// pepare netem loss command
 	delayCmd := action.CommandNetemLossRandom{
 		NetInterface: netInterface,
@@ -127,13 +425,15 @@ func NetemLossRandom(interval time.Duration, duration time.Duration, names []str
 		Correlation:  correlation,
 		Image:        image,
 	}
-	runChaosCommand(delayCmd, interval, names, pattern, Chaos.NetemLossRandomContainers)
-	return nil
+	cause := runChaosCommand(delayCmd, interval, names, pattern, Chaos.NetemLossRandomContainers, opts,
+		netemTeardown(netInterface, ips, image, names, pattern))
+	log.Info("NetemLossRandom experiment stopped: ", cause)
+	return cause
 }
 
 func NetemLossRate(interval time.Duration, duration time.Duration, names []string, pattern string,
 	netInterface string, ips []net.IP, image string,
-	p13 float64, p31 float64, p32 float64, p23 float64, p14 float64) error {
+	p13 float64, p31 float64, p32 float64, p23 float64, p14 float64, opts ExperimentOptions) error {
 	// pepare netem loss command
 	delayCmd := action.CommandNetemLossState{
 		NetInterface: netInterface,
@@ -146,6 +446,107 @@ func NetemLossRate(interval time.Duration, duration time.Duration, names []strin
 		P14:          p14,
 		Image:        image,
 	}
-	runChaosCommand(delayCmd, interval, names, pattern, Chaos.NetemLossStateContainers)
-	return nil
+	cause := runChaosCommand(delayCmd, interval, names, pattern, Chaos.NetemLossStateContainers, opts,
+		netemTeardown(netInterface, ips, image, names, pattern))
+	log.Info("NetemLossRate experiment stopped: ", cause)
+	return cause
+}
+
+/**
+* Corrupt a percentage of outgoing network packets for a set of containers identified by names []string or pattern string
+ */
+func NetemCorrupt(interval time.Duration, duration time.Duration, names []string, pattern string,
+	netInterface string, ips []net.IP, image string, percent float64, correlation float64, opts ExperimentOptions) error {
+	if err := validatePercent(percent); err != nil {
+		log.Error(err)
+		return err
+	}
+	// pepare netem corrupt command
+	corruptCmd := action.CommandNetemCorrupt{
+		NetInterface: netInterface,
+		IPs:          ips,
+		Duration:     duration,
+		Percent:      percent,
+		Correlation:  correlation,
+		Image:        image,
+	}
+	cause := runChaosCommand(corruptCmd, interval, names, pattern, Chaos.NetemCorruptContainers, opts,
+		netemTeardown(netInterface, ips, image, names, pattern))
+	log.Info("NetemCorrupt experiment stopped: ", cause)
+	return cause
+}
+
+/**
+* Duplicate a percentage of outgoing network packets for a set of containers identified by names []string or pattern string
+ */
+func NetemDuplicate(interval time.Duration, duration time.Duration, names []string, pattern string,
+	netInterface string, ips []net.IP, image string, percent float64, correlation float64, opts ExperimentOptions) error {
+	if err := validatePercent(percent); err != nil {
+		log.Error(err)
+		return err
+	}
+	// pepare netem duplicate command
+	duplicateCmd := action.CommandNetemDuplicate{
+		NetInterface: netInterface,
+		IPs:          ips,
+		Duration:     duration,
+		Percent:      percent,
+		Correlation:  correlation,
+		Image:        image,
+	}
+	cause := runChaosCommand(duplicateCmd, interval, names, pattern, Chaos.NetemDuplicateContainers, opts,
+		netemTeardown(netInterface, ips, image, names, pattern))
+	log.Info("NetemDuplicate experiment stopped: ", cause)
+	return cause
+}
+
+/**
+* Reorder a percentage of outgoing network packets for a set of containers identified by names []string or pattern string
+ */
+func NetemReorder(interval time.Duration, duration time.Duration, names []string, pattern string,
+	netInterface string, ips []net.IP, image string, percent float64, correlation float64, gap int, opts ExperimentOptions) error {
+	if err := validatePercent(percent); err != nil {
+		log.Error(err)
+		return err
+	}
+	// pepare netem reorder command
+	reorderCmd := action.CommandNetemReorder{
+		NetInterface: netInterface,
+		IPs:          ips,
+		Duration:     duration,
+		Percent:      percent,
+		Correlation:  correlation,
+		Gap:          gap,
+		Image:        image,
+	}
+	cause := runChaosCommand(reorderCmd, interval, names, pattern, Chaos.NetemReorderContainers, opts,
+		netemTeardown(netInterface, ips, image, names, pattern))
+	log.Info("NetemReorder experiment stopped: ", cause)
+	return cause
+}
+
+/**
+* Limit outgoing bandwidth for a set of containers identified by names []string or pattern string
+ */
+func NetemRate(interval time.Duration, duration time.Duration, names []string, pattern string,
+	netInterface string, ips []net.IP, image string, rate string, packetOverhead int, cellSize int, cellOverhead int, opts ExperimentOptions) error {
+	if err := validateRate(rate); err != nil {
+		log.Error(err)
+		return err
+	}
+	// pepare netem rate command
+	rateCmd := action.CommandNetemRate{
+		NetInterface:   netInterface,
+		IPs:            ips,
+		Duration:       duration,
+		Rate:           rate,
+		PacketOverhead: packetOverhead,
+		CellSize:       cellSize,
+		CellOverhead:   cellOverhead,
+		Image:          image,
+	}
+	cause := runChaosCommand(rateCmd, interval, names, pattern, Chaos.NetemRateContainers, opts,
+		netemTeardown(netInterface, ips, image, names, pattern))
+	log.Info("NetemRate experiment stopped: ", cause)
+	return cause
 }
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"../container"
+)
+
+func TestPopUndoByTokenIsOrderIndependent(t *testing.T) {
+	var ranA, ranB bool
+	tokenA := pushUndo(func() { ranA = true })
+	tokenB := pushUndo(func() { ranB = true })
+
+	// B completes (and is popped) before A, which must not disturb A's entry.
+	undoB, ok := popUndo(tokenB)
+	if !ok {
+		t.Fatal("popUndo(tokenB) = false, want true")
+	}
+	undoB()
+	if !ranB {
+		t.Error("undo for tokenB did not run")
+	}
+
+	if _, ok := popUndo(tokenB); ok {
+		t.Error("popUndo(tokenB) succeeded twice, want false the second time")
+	}
+
+	undoA, ok := popUndo(tokenA)
+	if !ok {
+		t.Fatal("popUndo(tokenA) = false, want true")
+	}
+	undoA()
+	if !ranA {
+		t.Error("undo for tokenA did not run")
+	}
+}
+
+func TestRunUndoStackRunsAllPending(t *testing.T) {
+	ran := map[int]bool{}
+	for i := 0; i < 3; i++ {
+		i := i
+		pushUndo(func() { ran[i] = true })
+	}
+
+	runUndoStack()
+
+	for i := 0; i < 3; i++ {
+		if !ran[i] {
+			t.Errorf("undo %d was not run by runUndoStack", i)
+		}
+	}
+	if _, ok := popUndo(1); ok {
+		t.Error("popUndo succeeded after runUndoStack drained the registry")
+	}
+}
+
+type fakeNetError struct{ error }
+
+func (fakeNetError) Timeout() bool   { return true }
+func (fakeNetError) Temporary() bool { return true }
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil error", nil, false},
+		{"net.Error", fakeNetError{errors.New("dial tcp: i/o timeout")}, true},
+		{"connection refused", errors.New("dial unix docker.sock: connect: connection refused"), true},
+		{"daemon unavailable", errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock"), true},
+		{"container not found", errors.New("No such container: abc123"), false},
+		{"invalid percent", ErrInvalidPercent, false},
+		{"unclassified error", errors.New("permission denied"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryable(tt.err); got != tt.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	opts := ExperimentOptions{RetryBaseDelay: 10 * time.Millisecond, RetryMaxDelay: 50 * time.Millisecond}
+
+	for attempt := 0; attempt < 5; attempt++ {
+		delay := backoffDelay(opts, attempt)
+		if delay < opts.RetryBaseDelay {
+			t.Errorf("backoffDelay(attempt=%d) = %v, want >= base %v", attempt, delay, opts.RetryBaseDelay)
+		}
+		if delay > opts.RetryMaxDelay+opts.RetryBaseDelay {
+			t.Errorf("backoffDelay(attempt=%d) = %v, want <= max+jitter %v", attempt, delay, opts.RetryMaxDelay+opts.RetryBaseDelay)
+		}
+	}
+}
+
+func TestBackoffDelayDefaults(t *testing.T) {
+	delay := backoffDelay(ExperimentOptions{}, 0)
+	if delay < time.Second || delay > 2*time.Second {
+		t.Errorf("backoffDelay with zero-value opts = %v, want within [1s, 2s]", delay)
+	}
+}
+
+func TestValidatePercent(t *testing.T) {
+	tests := []struct {
+		percent float64
+		wantErr bool
+	}{
+		{0, false},
+		{50, false},
+		{100, false},
+		{-0.1, true},
+		{100.1, true},
+	}
+	for _, tt := range tests {
+		err := validatePercent(tt.percent)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validatePercent(%v) error = %v, wantErr %v", tt.percent, err, tt.wantErr)
+		}
+		if err != nil && !errors.Is(err, ErrInvalidPercent) {
+			t.Errorf("validatePercent(%v) error = %v, want ErrInvalidPercent", tt.percent, err)
+		}
+	}
+}
+
+func TestRunChaosCommandOneShot(t *testing.T) {
+	TopContext = context.Background()
+
+	var calls int32
+	chaosFn := func(ctx context.Context, client container.Client, names []string, pattern string, cmd interface{}) error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runChaosCommand(nil, 0, nil, "", chaosFn, ExperimentOptions{}, nil)
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("runChaosCommand returned error %v, want nil", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("runChaosCommand did not return within 1s for interval=0; it is hanging after a one-shot tick")
+	}
+
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Fatalf("chaosFn invoked %d time(s), want exactly 1", got)
+	}
+}
+
+func TestValidateRate(t *testing.T) {
+	tests := []struct {
+		rate    string
+		wantErr bool
+	}{
+		{"1mbit", false},
+		{"500kbit", false},
+		{"2.5gbit", false},
+		{"100Kbit", false},
+		{"", true},
+		{"1 mbit", true},
+		{"fast", true},
+	}
+	for _, tt := range tests {
+		err := validateRate(tt.rate)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("validateRate(%q) error = %v, wantErr %v", tt.rate, err, tt.wantErr)
+		}
+	}
+}